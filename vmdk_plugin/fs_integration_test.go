@@ -0,0 +1,92 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+//
+// Integration test driving the pluggable-filesystem path end-to-end for
+// each supported fstype: create (format) + mount + write + unmount +
+// remount, checking the data written before the remount is still there
+// and that the second formatAndMount does not reformat over it.
+//
+// Needs a real scratch block device to format, so it is skipped unless
+// VMDK_TEST_DEVICE names one.
+//
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+)
+
+func TestCreateMountWriteUnmountRemount(t *testing.T) {
+	device := os.Getenv("VMDK_TEST_DEVICE")
+	if device == "" {
+		t.Skip("set VMDK_TEST_DEVICE to a scratch block device to run this integration test")
+	}
+
+	d := &vmdkDriver{}
+
+	for fstype := range fsTypeWhitelist {
+		fstype := fstype
+		t.Run(fstype, func(t *testing.T) {
+			name := "it-" + fstype
+			mountpoint := getMountPoint(name)
+			if err := fs.Mkdir(mountpoint); err != nil {
+				t.Fatalf("Mkdir(%s) failed: %s", mountpoint, err)
+			}
+			defer os.RemoveAll(mountpoint)
+
+			// Every subtest reuses the same device and formatAndMount only
+			// formats a blank one, so clear the filesystem signature the
+			// previous subtest left behind.
+			if out, err := exec.Command("wipefs", "-a", device).CombinedOutput(); err != nil {
+				t.Fatalf("wipefs %s failed: %s: %s", device, err, out)
+			}
+
+			if err := d.formatAndMount(name, device, fstype, ""); err != nil {
+				t.Fatalf("formatAndMount(%s) failed: %s", fstype, err)
+			}
+
+			payload := []byte("hello from " + fstype)
+			path := filepath.Join(mountpoint, "hello.txt")
+			if err := ioutil.WriteFile(path, payload, 0644); err != nil {
+				t.Fatalf("write failed: %s", err)
+			}
+
+			if err := fs.Unmount(mountpoint); err != nil {
+				t.Fatalf("unmount failed: %s", err)
+			}
+
+			// Remount: the device already carries a filesystem, so this
+			// must skip mkfs and mount the existing data as-is.
+			if err := d.formatAndMount(name, device, fstype, ""); err != nil {
+				t.Fatalf("remount formatAndMount(%s) failed: %s", fstype, err)
+			}
+			defer fs.Unmount(mountpoint)
+
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read after remount failed: %s", err)
+			}
+			if string(got) != string(payload) {
+				t.Fatalf("data mismatch after remount: got %q, want %q", got, payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	mockEsx = flag.Bool("mock-esx", false, "Mock ESX for testing, no attach/detach or mount/unmount done")
+	scope   = flag.String("scope", localScope, "Volume namespace scope reported to Docker via "+
+		"VolumeDriver.Capabilities: \"global\" (shared ESX datastore, safe for Swarm to reschedule "+
+		"volume-attached services across nodes) or \"local\"")
+	pluginID = flag.String("plugin-id", "vmdk", "Managed-plugin ID; selects the socket directory "+
+		"under "+managedPluginSockDir+" (see docker-plugin/config.json)")
+)
+
+func main() {
+	flag.Parse()
+
+	if *scope != globalScope && *scope != localScope {
+		log.Fatalf("Invalid --scope %q: must be %q or %q", *scope, globalScope, localScope)
+	}
+
+	d := newVmdkDriver(*mockEsx, *scope)
+
+	sockDir := filepath.Join(managedPluginSockDir, *pluginID)
+	if err := os.MkdirAll(sockDir, 0755); err != nil {
+		log.Fatalf("Failed to create plugin socket directory %s: %s", sockDir, err)
+	}
+	sockPath := filepath.Join(sockDir, pluginSockName)
+	os.Remove(sockPath) // stale socket from a previous run, if any
+
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %s", sockPath, err)
+	}
+
+	log.WithFields(
+		log.Fields{"socket": sockPath, "scope": *scope},
+	).Info("vmdk-plugin serving VolumeDriver requests ")
+	log.Fatal(http.Serve(listener, newRouter(d)))
+}
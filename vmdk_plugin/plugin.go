@@ -27,7 +27,7 @@ package main
 import (
 	"fmt"
 	"path/filepath"
-	"sync"
+	"regexp"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -42,39 +42,95 @@ const (
 	mountRoot        = "/mnt/vmdk" // VMDK block devices are mounted here
 	sleepBeforeMount = 1 * time.Second
 	watchPath        = "/dev/disk/by-path"
+
+	// removeWaitTimeout bounds how long Remove waits out an in-flight
+	// Unmount/Detach for a volume before giving up and reporting it still
+	// busy, rather than blocking forever.
+	removeWaitTimeout = 30 * time.Second
+
+	// scopes reported in response to VolumeDriver.Capabilities
+	globalScope = "global"
+	localScope  = "local"
+
+	defaultFstype = "ext4" // used when Create is not given an explicit "fstype" option
+	fstypeOption  = "fstype"
+	mkfsOption    = "mkfsopts"
+
+	// managedPluginSockDir is where Docker's managed-plugin (v2) runtime
+	// expects this plugin to serve its socket, under a directory named
+	// for the plugin's ID (see docker-plugin/config.json).
+	managedPluginSockDir = "/run/docker/plugins"
+	pluginSockName       = "vmdk.sock"
 )
 
+// fsTypeWhitelist bounds which "fstype" values we will ever pass to mkfs.*,
+// since that value flows from an untrusted Docker client into a shell-out.
+var fsTypeWhitelist = map[string]bool{
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+}
+
+// mkfsOptsPattern bounds "mkfsopts", the same as fsTypeWhitelist bounds
+// "fstype": it also flows from an untrusted Docker client straight into a
+// mkfs.* shell-out, but as free-form text rather than a small fixed set,
+// so we allow only characters real mkfs flags and their arguments need
+// and reject anything that could break out of a single argument (shell
+// metacharacters, quotes, whitespace other than a plain space).
+var mkfsOptsPattern = regexp.MustCompile(`^[A-Za-z0-9_,.=-]*( [A-Za-z0-9_,.=-]+)*$`)
+
 type vmdkDriver struct {
-	m          *sync.Mutex // create() serialization - for future use
-	useMockEsx bool
-	ops        vmdkops.VmdkOps
-	refCounts  refCountsMap
+	useMockEsx  bool
+	ops         vmdkops.VmdkOps
+	refCounts   refCountsMap
+	scope       string // scope reported to Docker: "global" (shared ESX datastore) or "local"
+	states      *volumeStates
+	quarantined *quarantinedVolumes     // volumes reconcileRefCounts found leaked at startup
+	reconciled  *reconciledPlaceholders // volumes reconcileRefCounts found still in use at startup
 }
 
 // creates vmdkDriver which to real ESX (useMockEsx=False) or a mock
-func newVmdkDriver(useMockEsx bool) *vmdkDriver {
+func newVmdkDriver(useMockEsx bool, scope string) *vmdkDriver {
 	var d *vmdkDriver
 	if useMockEsx {
 		d = &vmdkDriver{
-			m:          &sync.Mutex{},
-			useMockEsx: true,
-			ops:        vmdkops.VmdkOps{Cmd: vmdkops.MockVmdkCmd{}},
+			useMockEsx:  true,
+			ops:         vmdkops.VmdkOps{Cmd: vmdkops.MockVmdkCmd{}},
+			scope:       scope,
+			states:      newVolumeStates(),
+			quarantined: newQuarantinedVolumes(),
+			reconciled:  newReconciledPlaceholders(),
 		}
 	} else {
 		d = &vmdkDriver{
-			m:          &sync.Mutex{},
-			useMockEsx: false,
-			ops:        vmdkops.VmdkOps{Cmd: vmdkops.EsxVmdkCmd{}},
-			refCounts:  make(refCountsMap),
+			useMockEsx:  false,
+			ops:         vmdkops.VmdkOps{Cmd: vmdkops.EsxVmdkCmd{}},
+			refCounts:   make(refCountsMap),
+			scope:       scope,
+			states:      newVolumeStates(),
+			quarantined: newQuarantinedVolumes(),
+			reconciled:  newReconciledPlaceholders(),
 		}
 		d.refCounts.Init(d)
+		d.reconcileRefCounts()
 	}
 
 	return d
 }
-func (d *vmdkDriver) getRefCount(vol string) uint           { return d.refCounts.getCount(vol) }
-func (d *vmdkDriver) incrRefCount(vol string) uint          { return d.refCounts.incr(vol) }
-func (d *vmdkDriver) decrRefCount(vol string) (uint, error) { return d.refCounts.decr(vol) }
+
+// Capabilities tells Docker the scope of the volume namespace this plugin
+// manages, so Swarm knows whether a volume-attached service may be
+// rescheduled onto a different node.
+func (d *vmdkDriver) Capabilities(r volume.Request) volume.Response {
+	return volume.Response{Capabilities: volume.Capability{Scope: d.scope}}
+}
+func (d *vmdkDriver) getRefCount(vol string) uint { return d.refCounts.getCount(vol) }
+func (d *vmdkDriver) incrRefCount(vol string, mountID string) uint {
+	return d.refCounts.incr(vol, mountID)
+}
+func (d *vmdkDriver) decrRefCount(vol string, mountID string) (uint, error) {
+	return d.refCounts.decr(vol, mountID)
+}
 
 func getMountPoint(volName string) string {
 	return filepath.Join(mountRoot, volName)
@@ -111,7 +167,7 @@ func (d *vmdkDriver) List(r volume.Request) volume.Response {
 // Request attach and them mounts the volume.
 // Actual mount - send attach to ESX and do the in-guest magic
 // Returns mount point and  error (or nil)
-func (d *vmdkDriver) mountVolume(name string) (string, error) {
+func (d *vmdkDriver) mountVolume(name string, vs *volumeState) (string, error) {
 	mountpoint := getMountPoint(name)
 
 	// First, make sure  that mountpoint exists.
@@ -127,6 +183,19 @@ func (d *vmdkDriver) mountVolume(name string) (string, error) {
 		return mountpoint, fmt.Errorf("No device to mount.")
 	}
 
+	// The fstype (and mkfs options) were recorded on the ESX side at
+	// Create time; read them back so we mount with the filesystem the
+	// volume was created with.
+	status, err := d.ops.Get(name)
+	if err != nil {
+		return mountpoint, err
+	}
+	fstype, _ := status[fstypeOption].(string)
+	if fstype == "" {
+		fstype = defaultFstype
+	}
+	mkfsOpts, _ := status[mkfsOption].(string)
+
 	skipInotify := false
 
 	watcher, err := inotify.NewWatcher()
@@ -151,6 +220,7 @@ func (d *vmdkDriver) mountVolume(name string) (string, error) {
 	if err != nil {
 		return mountpoint, err
 	}
+	vs.transition(stateAttached)
 
 	device, err := fs.GetDevicePath(dev)
 	if err != nil {
@@ -159,7 +229,11 @@ func (d *vmdkDriver) mountVolume(name string) (string, error) {
 
 	if skipInotify {
 		time.Sleep(sleepBeforeMount)
-		return mountpoint, fs.Mount(mountpoint, "ext2", device)
+		err := d.formatAndMount(name, device, fstype, mkfsOpts)
+		if err == nil {
+			vs.transition(stateMounted)
+		}
+		return mountpoint, err
 	}
 loop:
 	for {
@@ -186,11 +260,34 @@ loop:
 		}
 	}
 
-	return mountpoint, fs.Mount(mountpoint, "ext2", device)
+	err = d.formatAndMount(name, device, fstype, mkfsOpts)
+	if err == nil {
+		vs.transition(stateMounted)
+	}
+	return mountpoint, err
+}
+
+// formatAndMount runs mkfs.<fstype> against device if it has no filesystem
+// signature yet (first mount after Create), then mounts it. mkfsOpts is
+// passed through verbatim to the mkfs invocation.
+func (d *vmdkDriver) formatAndMount(name string, device string, fstype string, mkfsOpts string) error {
+	blank, err := fs.IsBlockDeviceBlank(device)
+	if err != nil {
+		return err
+	}
+	if blank {
+		log.WithFields(
+			log.Fields{"name": name, "device": device, "fstype": fstype},
+		).Info("Formatting new volume ")
+		if err := fs.Mkfs(fstype, mkfsOpts, device); err != nil {
+			return err
+		}
+	}
+	return fs.MountFS(getMountPoint(name), fstype, device, "")
 }
 
 // Unmounts the volume and then requests detach
-func (d *vmdkDriver) unmountVolume(name string) error {
+func (d *vmdkDriver) unmountVolume(name string, vs *volumeState) error {
 	mountpoint := getMountPoint(name)
 	err := fs.Unmount(mountpoint)
 	if err != nil {
@@ -199,7 +296,10 @@ func (d *vmdkDriver) unmountVolume(name string) error {
 		).Error("Failed to unmount volume. Now trying to detach... ")
 		// Do not return error. Continue with detach.
 	}
-	return d.ops.Detach(name, nil)
+	vs.transition(stateDetaching)
+	err = d.ops.Detach(name, nil)
+	vs.transition(stateDetached)
+	return err
 }
 
 // The user wants to create a volume.
@@ -207,6 +307,25 @@ func (d *vmdkDriver) unmountVolume(name string) error {
 // (until Mount is called).
 // Name and driver specific options passed through to the ESX host
 func (d *vmdkDriver) Create(r volume.Request) volume.Response {
+	if r.Options == nil {
+		r.Options = make(map[string]string)
+	}
+	fstype := r.Options[fstypeOption]
+	if fstype == "" {
+		fstype = defaultFstype
+		r.Options[fstypeOption] = fstype
+	}
+	if !fsTypeWhitelist[fstype] {
+		msg := fmt.Sprintf("Unsupported filesystem type \"%s\" for volume %s", fstype, r.Name)
+		log.Error(msg)
+		return volume.Response{Err: msg}
+	}
+	if mkfsOpts := r.Options[mkfsOption]; !mkfsOptsPattern.MatchString(mkfsOpts) {
+		msg := fmt.Sprintf("Unsupported characters in mkfsopts \"%s\" for volume %s", mkfsOpts, r.Name)
+		log.Error(msg)
+		return volume.Response{Err: msg}
+	}
+
 	err := d.ops.Create(r.Name, r.Options)
 	if err != nil {
 		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Create volume failed ")
@@ -220,10 +339,32 @@ func (d *vmdkDriver) Create(r volume.Request) volume.Response {
 func (d *vmdkDriver) Remove(r volume.Request) volume.Response {
 	log.WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
 
+	if d.quarantined.has(r.Name) {
+		msg := fmt.Sprintf("Remove failure - volume %s is quarantined (found mounted with no owning "+
+			"container at startup) and needs an operator to resolve it first", r.Name)
+		log.Error(msg)
+		return volume.Response{Err: msg}
+	}
+
+	// Make sure no Unmount/Detach already in flight for this volume is
+	// still racing the refcount below - but only wait out that transient
+	// window, not the ordinary, long-lived Mounted state a volume sits in
+	// for as long as a container is using it. A volume genuinely still
+	// mounted is reported as an error just below, not blocked on forever.
+	if st := d.states.get(r.Name).waitWhileTransient(removeWaitTimeout); st == stateUnmounting || st == stateDetaching {
+		msg := fmt.Sprintf("Remove failure - timed out waiting for an in-flight unmount of volume %s "+
+			"to finish (state=%s)", r.Name, st)
+		log.Error(msg)
+		return volume.Response{Err: msg}
+	}
+
 	// Docker is supposed to block 'remove' command if the volume is used. Verify.
-	if d.getRefCount(r.Name) != 0 {
+	// d.reconciled.retire re-checks Docker for containers credited to this
+	// volume at startup reconciliation, since those were never recorded
+	// against refCounts by mount ID (see reconcile.go).
+	if refcnt := d.getRefCount(r.Name) + d.reconciled.retire(r.Name); refcnt != 0 {
 		msg := fmt.Sprintf("Remove failure - volume is still mounted. "+
-			" volume=%s, refcount=%d", r.Name, d.getRefCount(r.Name))
+			" volume=%s, refcount=%d", r.Name, refcnt)
 		log.Error(msg)
 		return volume.Response{Err: msg}
 	}
@@ -247,33 +388,61 @@ func (d *vmdkDriver) Path(r volume.Request) volume.Response {
 // Provide a volume to docker container - called once per container start.
 // We need to keep refcount and unmount on refcount drop to 0
 func (d *vmdkDriver) Mount(r volume.Request) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
-	d.m.Lock()
-	defer d.m.Unlock()
+	log.WithFields(log.Fields{"name": r.Name, "id": r.ID}).Info("Mounting volume ")
 
-	// If the volume is already mounted , just increase the refcount.
+	if d.quarantined.has(r.Name) {
+		msg := fmt.Sprintf("Mount failure - volume %s is quarantined (found mounted with no owning "+
+			"container at startup) and needs an operator to resolve it first", r.Name)
+		log.Error(msg)
+		return volume.Response{Err: msg}
+	}
+
+	// opMu only serializes Mount/Unmount for this one volume - unrelated
+	// volumes proceed concurrently.
+	vs := d.states.get(r.Name)
+	vs.opMu.Lock()
+	defer vs.opMu.Unlock()
+
+	// If the volume is already mounted for some other container, just
+	// add this mount ID to the active set and bump the refcount.
 	//
-	// Note: We are deliberately incrementing refcount first, before trying
+	// Note: We are deliberately recording the mount ID first, before trying
 	// to do anything else. If Mount fails, Docker will send Unmount request,
-	// and we will happily decrement the refcount there, and will fail the unmount
+	// and we will happily drop the ID there, and will fail the unmount
 	// since the volume will have been never mounted.
 	// Note: for new keys, GO maps return zero value, so no need for if_exists.
 
-	refcnt := d.incrRefCount(r.Name) // save map traversal
-	log.Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
-	if refcnt > 1 {
+	refcnt := d.incrRefCount(r.Name, r.ID) // save map traversal
+	total := refcnt + d.reconciled.count(r.Name)
+	log.Debugf("volume name=%s refcnt=%d", r.Name, total)
+	if total > 1 {
 		log.WithFields(
-			log.Fields{"name": r.Name, "refcount": refcnt},
+			log.Fields{"name": r.Name, "id": r.ID, "refcount": total},
 		).Info("Already mounted, skipping mount. ")
 		return volume.Response{Mountpoint: getMountPoint(r.Name)}
 	}
 
-	// This is the first time we are asked to mount the volume, so comply
-	mountpoint, err := d.mountVolume(r.Name)
+	// This is the first time we are asked to mount the volume, so comply.
+	// Block here if a Detach for this volume is still in flight.
+	vs.waitAndTransition(stateAttaching, stateDetached)
+	mountpoint, err := d.mountVolume(r.Name, vs)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
 		).Error("Failed to mount ")
+		if vs.get() == stateAttached {
+			// mountVolume got as far as a successful ESX Attach before
+			// failing later (e.g. formatting or the fs.MountFS call).
+			// The disk really is still attached - detach it for real
+			// before claiming Detached, or Remove/a later Mount would
+			// trust a state machine that is lying about reality.
+			if derr := d.ops.Detach(r.Name, nil); derr != nil {
+				log.WithFields(
+					log.Fields{"name": r.Name, "error": derr.Error()},
+				).Error("Failed to detach after a failed mount ")
+			}
+		}
+		vs.transition(stateDetached)
 		return volume.Response{Err: err.Error()}
 	}
 
@@ -283,28 +452,49 @@ func (d *vmdkDriver) Mount(r volume.Request) volume.Response {
 // Unmount request from Docker. If mount refcount is drop to 0,
 // unmount and detach from VM
 func (d *vmdkDriver) Unmount(r volume.Request) volume.Response {
-	log.WithFields(log.Fields{"name": r.Name}).Info("Unmounting Volume ")
-	d.m.Lock()
-	defer d.m.Unlock()
+	log.WithFields(log.Fields{"name": r.Name, "id": r.ID}).Info("Unmounting Volume ")
+
+	// opMu only serializes Mount/Unmount for this one volume - unrelated
+	// volumes proceed concurrently.
+	vs := d.states.get(r.Name)
+	vs.opMu.Lock()
+	defer vs.opMu.Unlock()
 
 	// if the volume is still used by other containers, just return OK
-	refcnt, err := d.decrRefCount(r.Name)
+	refcnt, err := d.decrRefCount(r.Name, r.ID)
 	if err != nil {
-		// something went wrong - yell, but still try to unmount
+		// The ID may be untracked because it was never a real mount ID -
+		// this volume might have been credited to d.reconciled at startup
+		// using Docker container IDs instead (see reconcile.go). Re-ask
+		// Docker which of those containers are still running rather than
+		// waiting forever on an ID match that can never happen.
 		log.WithFields(
-			log.Fields{"name": r.Name, "refcount": refcnt},
-		).Error("Refcount error - still trying to unmount...")
+			log.Fields{"name": r.Name, "id": r.ID, "refcount": refcnt},
+		).Warning("Refcount error - checking reconciled placeholders before trying to unmount... ")
+		refcnt += d.reconciled.retire(r.Name)
+	} else {
+		refcnt += d.reconciled.count(r.Name)
 	}
 	log.Debugf("volume name=%s refcnt=%d", r.Name, refcnt)
 	if refcnt >= 1 {
 		log.WithFields(
-			log.Fields{"name": r.Name, "refcount": refcnt},
+			log.Fields{"name": r.Name, "id": r.ID, "refcount": refcnt},
 		).Info("Still in use, skipping unmount request. ")
 		return volume.Response{Err: ""}
 	}
 
+	// A volume whose Mount failed was put back to Detached and never
+	// mounted: fail this Unmount instead of waiting for a Mounted state
+	// that will not come.
+	if st := vs.get(); st != stateMounted {
+		msg := fmt.Sprintf("Unmount failure - volume %s is not mounted (state=%s)", r.Name, st)
+		log.Error(msg)
+		return volume.Response{Err: msg}
+	}
+
 	// and if nobody needs it, unmount and detach
-	err = d.unmountVolume(r.Name)
+	vs.waitAndTransition(stateUnmounting, stateMounted)
+	err = d.unmountVolume(r.Name, vs)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
@@ -0,0 +1,252 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+//
+// Restart-time refcount reconciliation.
+//
+// refCounts.Init seeds zero counts for every volume the ESX side knows
+// about, but a plugin restart after a crash leaves no ground truth for
+// which of those volumes are actually mounted and in use right now. We
+// rebuild that ground truth by intersecting what is actually mounted
+// under mountRoot (from /proc/self/mountinfo) with what the Docker daemon
+// says is using each of those mounts (from its unix socket API), rather
+// than trusting a refcount of zero that may simply mean "never reconciled".
+//
+// The container IDs Docker reports this way are not mount IDs, so they are
+// tracked separately in reconciledPlaceholders rather than fed into
+// refCountsMap - see reconciledPlaceholders for how they get retired.
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const dockerSock = "/var/run/docker.sock"
+
+// quarantinedVolumes tracks volumes reconcileRefCounts found mounted but
+// claimed by no running container. Quarantining is more than a log line:
+// Mount/Remove consult this set and refuse to touch a quarantined volume,
+// since treating it as "never mounted" would stack a second mount (or a
+// Remove) on top of whatever the pre-crash session left behind.
+type quarantinedVolumes struct {
+	mu      sync.Mutex
+	volumes map[string]bool
+}
+
+func newQuarantinedVolumes() *quarantinedVolumes {
+	return &quarantinedVolumes{volumes: make(map[string]bool)}
+}
+
+func (q *quarantinedVolumes) add(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.volumes[name] = true
+}
+
+func (q *quarantinedVolumes) has(name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.volumes[name]
+}
+
+// reconciledPlaceholders tracks, per volume, the container IDs credited to
+// it by reconcileRefCounts at startup. These are Docker container IDs, not
+// the per-mount-instance IDs Docker sends on VolumeDriver.Unmount, so they
+// can never be retired by the normal refCountsMap.decr ID match - Docker
+// will never send one of these IDs back to us. Unmount instead retires
+// them by re-asking the Docker daemon which of the originally-credited
+// containers are still running.
+type reconciledPlaceholders struct {
+	mu      sync.Mutex
+	volumes map[string]map[string]bool
+}
+
+func newReconciledPlaceholders() *reconciledPlaceholders {
+	return &reconciledPlaceholders{volumes: make(map[string]map[string]bool)}
+}
+
+// set records the containers reconcileRefCounts found using vol at startup.
+func (rp *reconciledPlaceholders) set(vol string, containerIDs []string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	ids := make(map[string]bool, len(containerIDs))
+	for _, id := range containerIDs {
+		ids[id] = true
+	}
+	rp.volumes[vol] = ids
+}
+
+// count returns the number of reconciled containers still credited to vol,
+// without consulting Docker.
+func (rp *reconciledPlaceholders) count(vol string) uint {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return uint(len(rp.volumes[vol]))
+}
+
+// retire asks Docker which of vol's reconciled containers are still
+// running and drops the rest, returning how many remain credited. Called
+// from Unmount so a container that was already running before the plugin
+// restarted can still bring the refcount to zero once it stops, instead of
+// leaving vol mounted forever waiting for an ID match that will never
+// come.
+func (rp *reconciledPlaceholders) retire(vol string) uint {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	ids := rp.volumes[vol]
+	if len(ids) == 0 {
+		return 0
+	}
+
+	running, err := containersUsingVolume(vol)
+	if err != nil {
+		log.WithFields(
+			log.Fields{"name": vol, "error": err},
+		).Error("Failed to query Docker daemon while retiring reconciled placeholders ")
+		return uint(len(ids))
+	}
+
+	stillRunning := make(map[string]bool, len(running))
+	for _, id := range running {
+		stillRunning[id] = true
+	}
+	for id := range ids {
+		if !stillRunning[id] {
+			delete(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		delete(rp.volumes, vol)
+		return 0
+	}
+	return uint(len(ids))
+}
+
+// mountedVolumes walks /proc/self/mountinfo and returns the set of volume
+// names - the path of each mount point under mountRoot, relative to
+// mountRoot - that are currently mounted in this mount namespace.
+func mountedVolumes() (map[string]bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounted := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	prefix := mountRoot + "/"
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := fields[4]
+		if !strings.HasPrefix(mountPoint, prefix) {
+			continue
+		}
+		mounted[strings.TrimPrefix(mountPoint, prefix)] = true
+	}
+	return mounted, scanner.Err()
+}
+
+type dockerContainer struct {
+	ID string `json:"Id"`
+}
+
+// containersUsingVolume asks the Docker daemon, over its unix socket,
+// which running containers currently reference vol.
+func containersUsingVolume(vol string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{"volume": {vol}})
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			Dial: func(proto, addr string) (net.Conn, error) {
+				return net.Dial("unix", dockerSock)
+			},
+		},
+	}
+
+	resp, err := client.Get(fmt.Sprintf("http://unix/containers/json?filters=%s", string(filters)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	return ids, nil
+}
+
+// reconcileRefCounts rebuilds refCounts and d.reconciled from ground truth
+// after a restart. Volumes that are mounted but claimed by zero running
+// containers are leaked mounts: we log and add them to d.quarantined
+// (leave their refcount at zero) rather than silently detaching something
+// that might still be needed, or adopting a refcount nobody can explain.
+// Mount/Remove refuse quarantined volumes outright.
+//
+// Volumes claimed by running containers are credited to d.reconciled
+// rather than d.refCounts: the only IDs we have for them are Docker
+// container IDs, not the mount IDs Docker will actually send on a later
+// Unmount, so feeding them into refCountsMap would create entries decr can
+// never match and retire.
+func (d *vmdkDriver) reconcileRefCounts() {
+	mounted, err := mountedVolumes()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to scan existing mounts during refcount reconciliation ")
+		return
+	}
+
+	for vol := range mounted {
+		ids, err := containersUsingVolume(vol)
+		if err != nil {
+			log.WithFields(
+				log.Fields{"name": vol, "error": err},
+			).Error("Failed to query Docker daemon for volume usage during reconciliation ")
+			continue
+		}
+		if len(ids) == 0 {
+			log.WithFields(
+				log.Fields{"name": vol},
+			).Warning("Volume is mounted but claimed by no running container - quarantining leaked mount ")
+			d.quarantined.add(vol)
+			continue
+		}
+		d.reconciled.set(vol, ids)
+		d.states.get(vol).transition(stateMounted)
+		log.WithFields(
+			log.Fields{"name": vol, "containers": ids},
+		).Info("Reconciled refcount from running containers ")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+//
+// Tracks, per volume, the set of container mount IDs currently using it.
+//
+// Docker's Mount/Unmount requests carry an ID identifying the container
+// (or more precisely the mount instance) making the request. Keying on
+// that ID - rather than a bare counter - means a spurious extra
+// Mount+Unmount pair for the same container (as happens around
+// `docker cp`) cancels itself out instead of drifting the refcount, and
+// it lets us log which container is responsible for each mount.
+//
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// volRefCount is the set of mount IDs currently holding a volume mounted.
+type volRefCount struct {
+	ids map[string]bool
+}
+
+type refCountsMap map[string]*volRefCount
+
+// Init seeds the refcount map with zero counts for all volumes known to
+// the driver's ESX backend, so newly discovered volumes start clean.
+func (r refCountsMap) Init(d *vmdkDriver) {
+	volumes, err := d.ops.List()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to get volume list from ESX while initializing refcounts ")
+		return
+	}
+	for _, vol := range volumes {
+		r[vol.Name] = &volRefCount{ids: make(map[string]bool)}
+	}
+}
+
+func (r refCountsMap) getCount(vol string) uint {
+	rc := r[vol]
+	if rc == nil {
+		return 0
+	}
+	return uint(len(rc.ids))
+}
+
+// incr records that mountID is now using vol, and returns the resulting
+// refcount. Incrementing for an ID that is already recorded is a no-op on
+// the set (Docker is not expected to send the same ID twice without an
+// intervening Unmount), but is logged since it is unexpected.
+func (r refCountsMap) incr(vol string, mountID string) uint {
+	rc := r[vol]
+	if rc == nil {
+		rc = &volRefCount{ids: make(map[string]bool)}
+		r[vol] = rc
+	}
+	if rc.ids[mountID] {
+		log.WithFields(
+			log.Fields{"name": vol, "id": mountID},
+		).Warning("Mount ID already tracked for this volume ")
+	}
+	rc.ids[mountID] = true
+	return uint(len(rc.ids))
+}
+
+// decr removes mountID from vol's active set and returns the resulting
+// refcount. It is an error to decr an ID that was never incr'd. In that
+// case the set is left untouched, and we report its current size rather
+// than 0 - other mount IDs may still legitimately hold the volume, and
+// the caller must not treat an untracked ID as "nobody needs it anymore"
+// and detach out from under them.
+func (r refCountsMap) decr(vol string, mountID string) (uint, error) {
+	rc := r[vol]
+	if rc == nil || !rc.ids[mountID] {
+		return r.getCount(vol), fmt.Errorf("Decrementing refcount for %s with untracked mount ID %s", vol, mountID)
+	}
+	delete(rc.ids, mountID)
+	return uint(len(rc.ids)), nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+//
+// Explicit HTTP router for the Docker VolumeDriver v1.1 JSON protocol.
+//
+// go-plugins-helpers/volume.Handler already speaks this protocol, but
+// dispatches implicitly and assumes the legacy /etc/docker/plugins/*.spec
+// activation model. Docker's managed plugins (v2) instead expect the
+// plugin to serve /Plugin.Activate plus the VolumeDriver.* paths on a unix
+// socket under /run/docker/plugins/<pluginID>/, described by a shipped
+// config.json (see docker-plugin/config.json). newRouter builds that
+// dispatch table explicitly so it can be served on the managed-plugin
+// socket without going through the legacy spec-file path.
+//
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	activatePath = "/Plugin.Activate"
+	capsPath     = "/VolumeDriver.Capabilities"
+	createPath   = "/VolumeDriver.Create"
+	getPath      = "/VolumeDriver.Get"
+	listPath     = "/VolumeDriver.List"
+	mountPath    = "/VolumeDriver.Mount"
+	pathPath     = "/VolumeDriver.Path"
+	removePath   = "/VolumeDriver.Remove"
+	unmountPath  = "/VolumeDriver.Unmount"
+
+	pluginMediaType = "application/vnd.docker.plugins.v1.1+json"
+)
+
+// activateResponse answers /Plugin.Activate, telling Docker which plugin
+// interfaces this binary implements.
+type activateResponse struct {
+	Implements []string
+}
+
+// newRouter builds the explicit HTTP dispatch table for the VolumeDriver
+// v1.1 JSON protocol, to be served on the managed-plugin unix socket.
+func newRouter(d *vmdkDriver) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(activatePath, func(w http.ResponseWriter, r *http.Request) {
+		writePluginJSON(w, activateResponse{Implements: []string{"VolumeDriver"}})
+	})
+
+	handle(mux, capsPath, d.Capabilities)
+	handle(mux, createPath, d.Create)
+	handle(mux, getPath, d.Get)
+	handle(mux, listPath, d.List)
+	handle(mux, mountPath, d.Mount)
+	handle(mux, pathPath, d.Path)
+	handle(mux, removePath, d.Remove)
+	handle(mux, unmountPath, d.Unmount)
+
+	return mux
+}
+
+// handle wires a single VolumeDriver.* path to the vmdkDriver method that
+// implements it, decoding the request body and encoding the response per
+// the plugin protocol.
+func handle(mux *http.ServeMux, path string, call func(volume.Request) volume.Response) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		var req volume.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writePluginJSON(w, volume.Response{Err: err.Error()})
+			return
+		}
+		writePluginJSON(w, call(req))
+	})
+}
+
+func writePluginJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", pluginMediaType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to encode plugin response ")
+	}
+}
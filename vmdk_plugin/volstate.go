@@ -0,0 +1,177 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+//
+// Per-volume state machine guarding ESX-side Attach/Detach.
+//
+// opMu only serializes Mount vs Unmount for a single volume - other
+// volumes' Mount/Unmount calls never block on it. It does not by itself
+// stop a Detach that is already in flight for a volume from overlapping
+// with a newly-arrived Mount (or Remove) for that same volume. Each volume
+// gets its own state, and Mount/Unmount/Remove must transition through it,
+// blocking on illegal transitions instead of racing d.ops.Attach/Detach.
+//
+
+import (
+	"sync"
+	"time"
+)
+
+// transientPollInterval bounds how often waitWhileTransient rechecks state
+// while waiting out an in-flight Unmount/Detach. sync.Cond has no timed
+// wait, so we poll instead of blocking on the condition variable directly.
+const transientPollInterval = 20 * time.Millisecond
+
+type volState int
+
+const (
+	stateDetached volState = iota
+	stateAttaching
+	stateAttached
+	stateMounted
+	stateUnmounting
+	stateDetaching
+)
+
+func (s volState) String() string {
+	switch s {
+	case stateDetached:
+		return "detached"
+	case stateAttaching:
+		return "attaching"
+	case stateAttached:
+		return "attached"
+	case stateMounted:
+		return "mounted"
+	case stateUnmounting:
+		return "unmounting"
+	case stateDetaching:
+		return "detaching"
+	default:
+		return "unknown"
+	}
+}
+
+// volumeState is the state machine for a single volume, with its own lock
+// and condition variable so waiters block only on that volume.
+type volumeState struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state volState
+
+	// opMu is the striped lock Mount/Unmount hold for the duration of a
+	// single request against this volume. It is separate from mu, which
+	// guards state/cond: Mount/Unmount transition the state machine
+	// (and so re-lock mu) while already holding opMu.
+	opMu sync.Mutex
+}
+
+func newVolumeState() *volumeState {
+	vs := &volumeState{state: stateDetached}
+	vs.cond = sync.NewCond(&vs.mu)
+	return vs
+}
+
+// waitAndTransition blocks until the volume is in one of the `from`
+// states, then moves it to `to` and wakes any other waiters.
+func (vs *volumeState) waitAndTransition(to volState, from ...volState) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for !stateIn(vs.state, from) {
+		vs.cond.Wait()
+	}
+	vs.state = to
+	vs.cond.Broadcast()
+}
+
+// waitWhileTransient blocks only while the volume is mid Unmount/Detach
+// (stateUnmounting or stateDetaching), up to timeout, and returns whatever
+// state it observes once it stops waiting. It does NOT wait out the
+// ordinary, long-lived stateMounted - a volume actively in use by a
+// container would otherwise hang this call for as long as that container
+// runs. Used by Remove to make sure no Unmount/Detach already in flight is
+// still racing the refcount it is about to trust, without blocking on a
+// volume that is legitimately still mounted.
+func (vs *volumeState) waitWhileTransient(timeout time.Duration) volState {
+	deadline := time.Now().Add(timeout)
+	for {
+		vs.mu.Lock()
+		state := vs.state
+		vs.mu.Unlock()
+
+		if state != stateUnmounting && state != stateDetaching {
+			return state
+		}
+		if time.Now().After(deadline) {
+			return state
+		}
+		time.Sleep(transientPollInterval)
+	}
+}
+
+// get returns the volume's current state. Used by Mount to tell, after a
+// failed mountVolume, whether the ESX-side disk actually got attached
+// (stateAttached) before the failure, as opposed to never reaching ESX at
+// all (stateAttaching) - so it knows whether a real Detach is owed before
+// the state machine can honestly report Detached again.
+func (vs *volumeState) get() volState {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return vs.state
+}
+
+// transition moves the volume to `to` unconditionally and wakes waiters.
+// Used once we are already mid-operation and just advancing to the next
+// step (e.g. Attached -> Mounted).
+func (vs *volumeState) transition(to volState) {
+	vs.mu.Lock()
+	vs.state = to
+	vs.cond.Broadcast()
+	vs.mu.Unlock()
+}
+
+func stateIn(s volState, states []volState) bool {
+	for _, want := range states {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeStates is a striped lock of per-volume state machines: the map
+// mutex only guards inserting/looking up a volume's *volumeState, never
+// the state transitions themselves, so unrelated volumes never block on
+// each other.
+type volumeStates struct {
+	mapMu   sync.Mutex
+	volumes map[string]*volumeState
+}
+
+func newVolumeStates() *volumeStates {
+	return &volumeStates{volumes: make(map[string]*volumeState)}
+}
+
+func (vss *volumeStates) get(name string) *volumeState {
+	vss.mapMu.Lock()
+	defer vss.mapMu.Unlock()
+	vs, ok := vss.volumes[name]
+	if !ok {
+		vs = newVolumeState()
+		vss.volumes[name] = vs
+	}
+	return vs
+}
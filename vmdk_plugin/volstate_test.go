@@ -0,0 +1,144 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestVolumeStateConcurrentMountUnmountRemove fuzzes many concurrent
+// Mount/Unmount/Remove-shaped sequences against a single volume's state
+// machine and checks it always settles back to Detached, that a
+// Remove-style waiter never blocks on the ordinary Mounted state, and that
+// a waiter started mid-Unmount does not return until that Unmount/Detach
+// has completed.
+func TestVolumeStateConcurrentMountUnmountRemove(t *testing.T) {
+	states := newVolumeStates()
+	const volName = "fuzz-volume"
+	const iterations = 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < iterations; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vs := states.get(volName)
+
+			// Mount: Detached -> Attaching -> Attached -> Mounted
+			vs.waitAndTransition(stateAttaching, stateDetached)
+			vs.transition(stateAttached)
+			vs.transition(stateMounted)
+
+			// A Remove-style wait must not block on the ordinary Mounted
+			// state - it should see Mounted immediately.
+			if st := vs.waitWhileTransient(5 * time.Millisecond); st != stateMounted {
+				t.Errorf("waitWhileTransient returned %s while actively mounted, want %s", st, stateMounted)
+			}
+
+			// Unmount: Mounted -> Unmounting -> Detaching -> Detached.
+			// A concurrent Remove-style wait started while this Unmount is
+			// in flight must not return until it has completed. Other
+			// goroutines may already have moved the volume on from
+			// Detached by the time the waiter polls, so any non-transient
+			// state is a valid result; Unmounting/Detaching is not.
+			vs.waitAndTransition(stateUnmounting, stateMounted)
+			removeSaw := make(chan volState, 1)
+			go func() { removeSaw <- vs.waitWhileTransient(time.Second) }()
+			vs.transition(stateDetaching)
+			vs.transition(stateDetached)
+
+			if got := <-removeSaw; got == stateUnmounting || got == stateDetaching {
+				t.Errorf("waitWhileTransient returned %s, before the in-flight Unmount/Detach completed", got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := states.get(volName).get(); got != stateDetached {
+		t.Fatalf("expected final state %s, got %s", stateDetached, got)
+	}
+}
+
+// TestVolumeStateWaitWhileTransientIgnoresLongLivedMount proves
+// waitWhileTransient returns immediately for a volume that is genuinely
+// mounted and in active use, rather than blocking for as long as the
+// container using it runs - the bug the single fast-path fuzz test above
+// cannot catch, since it only ever holds stateMounted for a few
+// microseconds before moving on to Unmount.
+func TestVolumeStateWaitWhileTransientIgnoresLongLivedMount(t *testing.T) {
+	vs := newVolumeState()
+	vs.transition(stateAttached)
+	vs.transition(stateMounted)
+
+	done := make(chan volState, 1)
+	go func() { done <- vs.waitWhileTransient(50 * time.Millisecond) }()
+
+	select {
+	case got := <-done:
+		if got != stateMounted {
+			t.Fatalf("got %s, want %s", got, stateMounted)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitWhileTransient blocked on a long-lived Mounted volume instead of returning immediately")
+	}
+}
+
+// TestVolumeStateWaitWhileTransientTimesOutOnStuckDetach makes sure a
+// Detach that never completes does not hang Remove forever: the timeout
+// must win and report the stuck transient state back to the caller.
+func TestVolumeStateWaitWhileTransientTimesOutOnStuckDetach(t *testing.T) {
+	vs := newVolumeState()
+	vs.transition(stateUnmounting)
+	vs.transition(stateDetaching) // deliberately never transitions further
+
+	start := time.Now()
+	got := vs.waitWhileTransient(30 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("waitWhileTransient took %s, should have honored its timeout", elapsed)
+	}
+	if got != stateDetaching {
+		t.Fatalf("got %s, want %s (timed out mid-detach)", got, stateDetaching)
+	}
+}
+
+// TestVolumeStateMountBlocksOnDetaching makes sure a new Mount attempt
+// waits for an in-flight Detach to finish rather than racing ESX's
+// Attach against its Detach for the same volume.
+func TestVolumeStateMountBlocksOnDetaching(t *testing.T) {
+	vs := newVolumeState()
+	vs.transition(stateDetaching)
+
+	attached := make(chan struct{})
+	go func() {
+		vs.waitAndTransition(stateAttaching, stateDetached)
+		close(attached)
+	}()
+
+	select {
+	case <-attached:
+		t.Fatal("Mount proceeded to Attaching while Detach was still in flight")
+	case <-time.After(5 * time.Millisecond):
+	}
+
+	vs.transition(stateDetached)
+
+	select {
+	case <-attached:
+	case <-time.After(time.Second):
+		t.Fatal("Mount never unblocked after Detach completed")
+	}
+}